@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// buildTLSConfig turns a Test's TLS block into a *tls.Config for the
+// dialer. A nil TLSConfig leaves the system default TLS config in place.
+func buildTLSConfig(t *TLSConfig) (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		ServerName:         t.ServerName,
+	}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.ClientCertFile != "" || t.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCertFile, t.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// buildHeaders turns a Test's Headers/BasicAuth into the requestHeader
+// argument for dialer.Dial. Header values go through os.Expand so
+// "Bearer ${TOKEN}" is interpolated from the environment at dial time.
+func buildHeaders(wt Test) http.Header {
+	header := http.Header{}
+	for k, v := range wt.Headers {
+		header.Set(k, os.Expand(v, os.Getenv))
+	}
+	if wt.BasicAuth != nil {
+		creds := wt.BasicAuth.User + ":" + wt.BasicAuth.Pass
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+	}
+	return header
+}
+
+// certSummaries renders a short, loggable summary of a TLS peer's
+// certificate chain for diagnostics.
+func certSummaries(certs []*x509.Certificate) []string {
+	summaries := make([]string, len(certs))
+	for i, c := range certs {
+		summaries[i] = fmt.Sprintf("subject=%s issuer=%s not_after=%s", c.Subject, c.Issuer, c.NotAfter.Format("2006-01-02T15:04:05Z07:00"))
+	}
+	return summaries
+}
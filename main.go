@@ -2,14 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,6 +22,13 @@ type Flags struct {
 	TestsFile string
 	Runs      int
 	OutDir    string
+
+	Stdout      bool
+	WebhookURL  string
+	MetricsAddr string
+
+	Concurrency int
+	Once        bool
 }
 
 func (f *Flags) Register(fs *flag.FlagSet) {
@@ -30,6 +36,11 @@ func (f *Flags) Register(fs *flag.FlagSet) {
 	fs.StringVar(&f.OutDir, "dir", "", "directory to output result files into")
 	fs.StringVar(&f.TestsFile, "tests", "", "tests file to load urls/rules from")
 	fs.IntVar(&f.Runs, "n", 1, "number of time to run each test (0=run forever)")
+	fs.BoolVar(&f.Stdout, "out.stdout", false, "write each test result as JSON to stdout")
+	fs.StringVar(&f.WebhookURL, "out.webhook", "", "HTTP POST each test result as JSON to this URL")
+	fs.StringVar(&f.MetricsAddr, "metrics.addr", "", "address to serve Prometheus metrics on, e.g. :9090 (disabled if empty)")
+	fs.IntVar(&f.Concurrency, "concurrency", 10, "maximum number of tests running at the same time")
+	fs.BoolVar(&f.Once, "once", false, "run every test exactly once and exit non-zero if any failed, for CI probes")
 
 }
 
@@ -72,6 +83,48 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// job is one request onto the worker pool: run wt and report success on
+// done.
+type job struct {
+	wt   Test
+	done chan bool
+}
+
+// dispatch submits wt to the worker pool and blocks until it has run,
+// returning whether it succeeded.
+func dispatch(jobs chan<- job, wt Test) bool {
+	done := make(chan bool, 1)
+	jobs <- job{wt: wt, done: done}
+	return <-done
+}
+
+// runTest runs wt once, honoring MaxDuration as a context deadline, and
+// fans the result out to sinks.
+func runTest(wt Test, sinks []ResultSink) bool {
+	ctx := context.Background()
+	if wt.MaxDuration != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wt.MaxDuration.D())
+		defer cancel()
+	}
+
+	wr, err := testWS(ctx, wt)
+	if err != nil {
+		log.Println("failed ws test", err)
+		return false
+	}
+	if !wr.IsSuccess() {
+		log.Println("TEST UNSUCCESSFUL")
+	}
+	log.Println(wr.ID, wr.IsSuccess())
+	for _, sink := range sinks {
+		if err := sink.Result(wr); err != nil {
+			log.Println("result sink error", err)
+		}
+	}
+	return wr.IsSuccess()
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -114,48 +167,95 @@ func main() {
 
 	}
 
+	var sinks []ResultSink
+	if flags.OutDir != "" {
+		sinks = append(sinks, &FileSink{Dir: flags.OutDir})
+	}
+	if flags.Stdout {
+		sinks = append(sinks, StdoutSink{})
+	}
+	if flags.WebhookURL != "" {
+		sinks = append(sinks, &WebhookSink{URL: flags.WebhookURL})
+	}
+	if flags.MetricsAddr != "" {
+		metrics := NewMetricsSink()
+		sinks = append(sinks, metrics)
+		go func() {
+			log.Fatal(metrics.Serve(flags.MetricsAddr))
+		}()
+	}
+
+	concurrency := flags.Concurrency
+	if concurrency <= 0 {
+		concurrency = 10
+	}
+
+	jobs := make(chan job)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				j.done <- runTest(j.wt, sinks)
+			}
+		}()
+	}
+
+	if flags.Once {
+		var failed int32
+		var once sync.WaitGroup
+		for _, v := range tests {
+			wt := v
+			once.Add(1)
+			go func() {
+				defer once.Done()
+				if !dispatch(jobs, wt) {
+					atomic.AddInt32(&failed, 1)
+				}
+			}()
+		}
+		once.Wait()
+		close(jobs)
+		workers.Wait()
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var scheduled, unscheduled []Test
+	for _, wt := range tests {
+		if wt.Schedule != "" {
+			scheduled = append(scheduled, wt)
+		} else {
+			unscheduled = append(unscheduled, wt)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	var wg sync.WaitGroup
+	if len(scheduled) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runScheduler(ctx, scheduled, jobs)
+		}()
+	}
 
-	for _, v := range tests {
+	for _, v := range unscheduled {
 		wt := v
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			n := 0
-		loop:
 			for {
-				if flags.Runs > 0 {
-					if n >= flags.Runs {
-						break loop
-					}
-				}
-				wr, err := testWS(context.Background(), wt)
-				if err != nil {
-					log.Println("failed ws test", err)
-				} else {
-					if !wr.IsSuccess() {
-						log.Println("TEST UNSUCCESSFUL")
-					}
-					// spew.Dump(wr)
-					// data, err := yaml.Marshal(&wr)
-					data, err := json.MarshalIndent(&wr, "", "  ")
-					if err != nil {
-						log.Fatal(err)
-					}
-					if flags.OutDir != "" {
-						filename := filepath.Join(
-							flags.OutDir,
-							fmt.Sprintf("%v__%v.json",
-								wr.Test.Name,
-								wr.StartedAt.Format("2006-01-02__150405.999999999"),
-							),
-						)
-						if err := ioutil.WriteFile(filename, data, 0600); err != nil {
-							log.Fatal(err)
-						}
-					}
-					log.Println(wr.IsSuccess(), string(data))
+				if flags.Runs > 0 && n >= flags.Runs {
+					return
 				}
+				dispatch(jobs, wt)
 				time.Sleep(time.Duration(wt.Sleep))
 				n++
 			}
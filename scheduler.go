@@ -0,0 +1,128 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// schedule computes successive run times for a Test's Schedule field,
+// which is either "every <duration>" (e.g. "every 30s") or a standard
+// 5-field cron expression.
+type schedule struct {
+	interval time.Duration
+	cron     cron.Schedule
+}
+
+func parseSchedule(expr string) (*schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if rest := strings.TrimPrefix(expr, "every "); rest != expr {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q: duration must be positive", expr)
+		}
+		return &schedule{interval: d}, nil
+	}
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+	}
+	return &schedule{cron: sched}, nil
+}
+
+func (s *schedule) next(after time.Time) time.Time {
+	if s.interval > 0 {
+		return after.Add(s.interval)
+	}
+	return s.cron.Next(after)
+}
+
+// scheduledRun is one entry in the scheduler's min-heap: a test and the
+// next time it is due to run.
+type scheduledRun struct {
+	wt     Test
+	sched  *schedule
+	nextAt time.Time
+}
+
+// runHeap is a container/heap of scheduledRuns ordered by nextAt, so the
+// scheduler can always sleep until the single soonest run is due.
+type runHeap []*scheduledRun
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].nextAt.Before(h[j].nextAt) }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *runHeap) Push(x interface{}) {
+	*h = append(*h, x.(*scheduledRun))
+}
+
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// runScheduler dispatches tests with a Schedule onto jobs at their
+// scheduled times. Dispatch for a given test runs in its own goroutine so a
+// slow run never delays other tests' schedules, but that test's own next
+// run is only computed and re-queued once its current run finishes, so a
+// run that outlives its interval can never pile up unbounded goroutines or
+// a burst of stale catch-up runs; it runs until ctx is canceled.
+func runScheduler(ctx context.Context, tests []Test, jobs chan<- job) {
+	h := &runHeap{}
+	heap.Init(h)
+	now := time.Now()
+	for _, wt := range tests {
+		sched, err := parseSchedule(wt.Schedule)
+		if err != nil {
+			log.Println(wt.Name, "invalid schedule, skipping:", err)
+			continue
+		}
+		heap.Push(h, &scheduledRun{wt: wt, sched: sched, nextAt: now})
+	}
+
+	done := make(chan *scheduledRun)
+	pending := 0
+
+	for h.Len() > 0 || pending > 0 {
+		var timer *time.Timer
+		if h.Len() > 0 {
+			timer = time.NewTimer(time.Until((*h)[0].nextAt))
+		} else {
+			timer = time.NewTimer(time.Hour)
+		}
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case run := <-done:
+			timer.Stop()
+			pending--
+			run.nextAt = run.sched.next(time.Now())
+			heap.Push(h, run)
+		case <-timer.C:
+			if h.Len() == 0 {
+				continue
+			}
+			run := heap.Pop(h).(*scheduledRun)
+			pending++
+			go func() {
+				dispatch(jobs, run.wt)
+				done <- run
+			}()
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ResultSink receives each TestResult as a test run completes. main wires up
+// one sink per configured output (file, stdout, webhook, metrics) so a run
+// can be piped into several places at once.
+type ResultSink interface {
+	Result(wr TestResult) error
+}
+
+// FileSink writes each result as an indented JSON file into Dir, named the
+// same way the tool always has: "<test name>__<started at>.json".
+type FileSink struct {
+	Dir string
+}
+
+func (s *FileSink) Result(wr TestResult) error {
+	data, err := json.MarshalIndent(&wr, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(
+		s.Dir,
+		fmt.Sprintf("%v__%v.json",
+			wr.Test.Name,
+			wr.StartedAt.Format("2006-01-02__150405.999999999"),
+		),
+	)
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+// StdoutSink writes each result as an indented JSON document to stdout.
+type StdoutSink struct{}
+
+func (StdoutSink) Result(wr TestResult) error {
+	data, err := json.MarshalIndent(&wr, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(data))
+	return err
+}
+
+// WebhookSink HTTP POSTs each result as a JSON body to URL, for piping
+// results into an external collector instead of reading files off disk.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *WebhookSink) Result(wr TestResult) error {
+	data, err := json.Marshal(&wr)
+	if err != nil {
+		return err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Post(s.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned status %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// MetricsSink records each result into a Prometheus registry: per-test run
+// and failure counters, histograms for handshake duration, message-read
+// latency and ping RTT, and a ws_test_up gauge for the last result.
+type MetricsSink struct {
+	Registry *prometheus.Registry
+
+	runsTotal     *prometheus.CounterVec
+	failuresTotal *prometheus.CounterVec
+	handshakeDur  *prometheus.HistogramVec
+	readLatency   *prometheus.HistogramVec
+	pingRTT       *prometheus.HistogramVec
+	up            *prometheus.GaugeVec
+}
+
+func NewMetricsSink() *MetricsSink {
+	m := &MetricsSink{
+		Registry: prometheus.NewRegistry(),
+		runsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ws_test_runs_total",
+			Help: "Total number of test runs.",
+		}, []string{"test"}),
+		failuresTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ws_test_failures_total",
+			Help: "Total number of failed test runs, by failure reason.",
+		}, []string{"test", "reason"}),
+		handshakeDur: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ws_test_handshake_duration_seconds",
+			Help: "Time taken to establish the websocket connection.",
+		}, []string{"test"}),
+		readLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ws_test_message_read_latency_seconds",
+			Help: "Time the reader spent blocked waiting for each message to arrive.",
+		}, []string{"test"}),
+		pingRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ws_test_ping_rtt_seconds",
+			Help: "Round-trip time of keepalive pings.",
+		}, []string{"test"}),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ws_test_up",
+			Help: "Whether the last run of the test succeeded (1) or not (0).",
+		}, []string{"test"}),
+	}
+	m.Registry.MustRegister(m.runsTotal, m.failuresTotal, m.handshakeDur, m.readLatency, m.pingRTT, m.up)
+	return m
+}
+
+func (m *MetricsSink) Result(wr TestResult) error {
+	name := wr.Test.Name
+	m.runsTotal.WithLabelValues(name).Inc()
+
+	if wr.IsSuccess() {
+		m.up.WithLabelValues(name).Set(1)
+	} else {
+		m.up.WithLabelValues(name).Set(0)
+		m.failuresTotal.WithLabelValues(name, failureReason(wr)).Inc()
+	}
+
+	if d, ok := connectDuration(wr); ok {
+		m.handshakeDur.WithLabelValues(name).Observe(d.Seconds())
+	}
+	for _, msg := range wr.Messages {
+		m.readLatency.WithLabelValues(name).Observe(msg.ReadLatency.D().Seconds())
+	}
+	for _, p := range wr.Pings {
+		if p.RTT != 0 {
+			m.pingRTT.WithLabelValues(name).Observe(p.RTT.D().Seconds())
+		}
+	}
+	return nil
+}
+
+// Serve starts an HTTP server exposing the registry on /metrics. It blocks
+// until the server stops, so callers should run it in its own goroutine.
+func (m *MetricsSink) Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(addr, mux)
+}
+
+// connectDuration returns the handshake time of the last successful connect
+// attempt: the time between its LogConnect and the LogConnectSuccess that
+// immediately follows it. With Reconnect enabled a run can log several
+// connect attempts, so a LogConnect is only paired with the next
+// LogConnectSuccess, never with one left over from an earlier attempt (e.g.
+// a failed redial after an earlier successful connect).
+func connectDuration(wr TestResult) (time.Duration, bool) {
+	var pendingConnectAt DurationMS
+	var pending bool
+	var duration time.Duration
+	var have bool
+	for _, l := range wr.Log {
+		switch l.Kind {
+		case LogConnect:
+			pendingConnectAt = l.CreatedAt
+			pending = true
+		case LogConnectSuccess:
+			if pending {
+				duration = l.CreatedAt.D() - pendingConnectAt.D()
+				have = true
+				pending = false
+			}
+		}
+	}
+	return duration, have
+}
+
+// failureReason picks a short label describing why a result was
+// unsuccessful, for the ws_test_failures_total reason label.
+func failureReason(wr TestResult) string {
+	if !wr.ConnectOK {
+		return LogConnectFail
+	}
+	for _, l := range wr.Log {
+		if writeMessageFaliures[l.Kind] || (l.Step == StepReadMessage && readMessageFaliures[l.Kind]) || pingFaliures[l.Kind] {
+			return l.Kind
+		}
+	}
+	if wr.Test.ExpectServerClose != 0 && wr.ServerCloseCode != wr.Test.ExpectServerClose {
+		return "unexpected_close_code"
+	}
+	if wr.Test.ExpectMessages != 0 && wr.MessagesReceived != wr.Test.ExpectMessages {
+		return "message_count_mismatch"
+	}
+	if len(wr.Test.Steps) != 0 {
+		return "step_mismatch"
+	}
+	return "unknown"
+}
@@ -2,16 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/jpillora/backoff"
+	"github.com/tidwall/gjson"
 )
 
 type TestsFile []Test
@@ -46,15 +53,166 @@ type Test struct {
 
 	Sleep Duration `json:"sleep" yaml:"sleep"`
 
-	// Fail test if it takes longer this, (doesn't abort test, just for validation)
+	// Fail test if it takes longer than this. Also passed to testWS as a
+	// context deadline, so a test that overruns it is aborted rather than
+	// left to run to completion.
 	MaxDuration Duration `json:"max_duration" yaml:"max_duration"`
+
+	// if >0 a websocket ping frame is sent every PingInterval for the
+	// duration of the test, each one tracked for a pong reply. Only one
+	// ping is outstanding at a time: the next ping waits until the
+	// previous one's PongTimeout has elapsed, so pings are spaced by
+	// whichever of PingInterval and PongTimeout is longer.
+	PingInterval Duration `json:"ping_interval" yaml:"ping_interval"`
+
+	// how long to wait for a pong after sending a ping before counting it
+	// as missed, defaults to 10s
+	PongTimeout Duration `json:"pong_timeout" yaml:"pong_timeout"`
+
+	// if true, a failed dial or a read/write failure mid-run (as well as an
+	// unexpected server close code or an unmatched step) redials
+	// instead of ending the test, using an exponential backoff between
+	// attempts. The TestResult keeps accumulating under the same ID.
+	Reconnect bool `json:"reconnect" yaml:"reconnect"`
+
+	// backoff bounds for Reconnect, default to 1s/30s/2 if left unset
+	ReconnectMin    Duration `json:"reconnect_min" yaml:"reconnect_min"`
+	ReconnectMax    Duration `json:"reconnect_max" yaml:"reconnect_max"`
+	ReconnectFactor float64  `json:"reconnect_factor" yaml:"reconnect_factor"`
+
+	// If set, the script of Steps is walked instead of the
+	// SendTextMessage/ExpectMessages protocol above, so a test can
+	// describe a real multi-message conversation with per-step
+	// assertions.
+	Steps []Step `json:"steps,omitempty" yaml:"steps,omitempty"`
+
+	// TLS configures the dialer's *tls.Config for wss:// endpoints. Left
+	// unset, the system default TLS config is used.
+	TLS *TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+
+	// Extra headers sent with the handshake request. Values go through
+	// os.Expand, so "Bearer ${TOKEN}" pulls TOKEN from the environment.
+	// Excluded from JSON (results, logs) since a value that isn't routed
+	// through ${ENV} may itself be a bearer token or other secret; only
+	// buildHeaders reads this field, straight off the config.
+	Headers map[string]string `json:"-" yaml:"headers,omitempty"`
+
+	// Subprotocols sent with the handshake request, see RFC 6455 1.9.
+	Subprotocols []string `json:"subprotocols,omitempty" yaml:"subprotocols,omitempty"`
+
+	// If set, adds an HTTP Basic Authorization header to the handshake
+	// request.
+	BasicAuth *BasicAuth `json:"basic_auth,omitempty" yaml:"basic_auth,omitempty"`
+
+	// If set, this test is run repeatedly on a schedule instead of the
+	// Runs/Sleep loop: either "every <duration>" (e.g. "every 30s") or a
+	// standard 5-field cron expression.
+	Schedule string `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+}
+
+// TLSConfig configures the TLS dialer used for wss:// endpoints.
+type TLSConfig struct {
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file" yaml:"ca_file"`
+	ClientCertFile     string `json:"client_cert_file" yaml:"client_cert_file"`
+	ClientKeyFile      string `json:"client_key_file" yaml:"client_key_file"`
+	ServerName         string `json:"server_name" yaml:"server_name"`
+}
+
+// BasicAuth holds HTTP Basic Authorization credentials for the handshake.
+// Pass is excluded from JSON (results, logs) so it never ends up in a
+// FileSink/WebhookSink artifact or the process's own logs.
+type BasicAuth struct {
+	User string `json:"user" yaml:"user"`
+	Pass string `json:"-" yaml:"pass"`
+}
+
+// Step is one action in a Test.Steps scripted conversation.
+type Step struct {
+	// Kind selects the action: send_text, send_binary, send_ping,
+	// expect_text, expect_binary, expect_close or wait.
+	Kind string `json:"kind" yaml:"kind"`
+
+	// Body is the payload for a send_text/send_ping step.
+	Body string `json:"body,omitempty" yaml:"body,omitempty"`
+
+	// BinaryBody is the payload for a send_binary step.
+	BinaryBody []byte `json:"binary_body,omitempty" yaml:"binary_body,omitempty"`
+
+	// Match constrains what an expect_text/expect_binary/expect_close
+	// step accepts. A step with no Match accepts any message/close of
+	// the expected kind.
+	Match *Match `json:"match,omitempty" yaml:"match,omitempty"`
+
+	// Timeout overrides MessageReadTimeout/MessageWriteTimeout for this
+	// step only.
+	Timeout Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// Wait is how long a "wait" step sleeps for.
+	Wait Duration `json:"wait,omitempty" yaml:"wait,omitempty"`
+}
+
+const (
+	StepKindSendText     = "send_text"
+	StepKindSendBinary   = "send_binary"
+	StepKindSendPing     = "send_ping"
+	StepKindExpectText   = "expect_text"
+	StepKindExpectBinary = "expect_binary"
+	StepKindExpectClose  = "expect_close"
+	StepKindWait         = "wait"
+)
+
+// Match describes how an expect_* step's message is validated. At most one
+// of Literal, Regexp or JSONPath should be set; JSONPath extracts a value
+// with a gjson-style path and compares it against Equals. For expect_close,
+// Equals is compared against the close code instead.
+type Match struct {
+	Literal  string `json:"literal,omitempty" yaml:"literal,omitempty"`
+	Regexp   string `json:"regexp,omitempty" yaml:"regexp,omitempty"`
+	JSONPath string `json:"json_path,omitempty" yaml:"json_path,omitempty"`
+	Equals   string `json:"equals,omitempty" yaml:"equals,omitempty"`
+}
+
+func (m *Match) matches(body string) (bool, error) {
+	if m == nil {
+		return true, nil
+	}
+	switch {
+	case m.Literal != "":
+		return body == m.Literal, nil
+	case m.Regexp != "":
+		return regexp.MatchString(m.Regexp, body)
+	case m.JSONPath != "":
+		return gjson.Get(body, m.JSONPath).String() == m.Equals, nil
+	default:
+		return true, nil
+	}
+}
+
+// StepResult records the outcome of a single Step.
+type StepResult struct {
+	Index     int        `json:"index"`
+	Kind      string     `json:"kind"`
+	Matched   bool       `json:"matched"`
+	StartedAt DurationMS `json:"started_at"`
+	Body      string     `json:"body,omitempty"`
+	Err       error      `json:"error,omitempty"`
 }
 
 // WebSocketMessage .
 type WebsocketMessage struct {
-	ReceivedAt DurationMS  `json:"received_at,omitempty"`
-	Type       int         `json:"type,omitempty"`
-	Body       interface{} `json:"body,omitempty"`
+	ReceivedAt  DurationMS  `json:"received_at,omitempty"`
+	ReadLatency DurationMS  `json:"read_latency,omitempty"`
+	Type        int         `json:"type,omitempty"`
+	Body        interface{} `json:"body,omitempty"`
+}
+
+// PingResult records the outcome of a single keepalive ping.
+type PingResult struct {
+	Sequence   int        `json:"sequence"`
+	SentAt     DurationMS `json:"sent_at"`
+	ReceivedAt DurationMS `json:"received_at,omitempty"`
+	RTT        DurationMS `json:"rtt,omitempty"`
 }
 
 // Log .
@@ -87,6 +245,12 @@ const (
 	LogClientCloseConnection        = "client_close_connection"
 	LogClientCloseConnectionSuccess = "client_close_connection_success"
 	LogClientCloseConnectionFailed  = "client_close_connection_failed"
+	LogPingSent                     = "ping_sent"
+	LogPongReceived                 = "pong_received"
+	LogPongTimeout                  = "pong_timeout"
+	LogReconnect                    = "reconnect"
+	LogSubprotocolNegotiated        = "subprotocol_negotiated"
+	LogTLSPeerCertificates          = "tls_peer_certificates"
 
 	StepConnect               = ""
 	StepSendText              = ""
@@ -94,6 +258,8 @@ const (
 	StepClientClose           = ""
 	StepExpectedServerClose   = "expected_server_close"
 	StepUnexpectedServerClose = "unexpected_server_close"
+	StepPing                  = "ping"
+	StepScript                = "script"
 	// Step
 )
 
@@ -109,6 +275,10 @@ var (
 		LogReadMessageNetError: true,
 		LogReadMessageError:    true,
 	}
+
+	pingFaliures = map[string]bool{
+		LogPongTimeout: true,
+	}
 )
 
 type TestResult struct {
@@ -120,6 +290,8 @@ type TestResult struct {
 	Messages         []WebsocketMessage `json:"messages"`
 	ServerCloseCode  int                `json:"server_close_code"`
 	CloseOK          bool               `json:"close_ok"`
+	Pings            []PingResult       `json:"pings,omitempty"`
+	Steps            []StepResult       `json:"steps,omitempty"`
 	Log              []Log              `json:"log"`
 }
 
@@ -133,6 +305,16 @@ func (r TestResult) IsSuccess() bool {
 	if t.ExpectMessages != 0 && (r.MessagesReceived != t.ExpectMessages) {
 		return false
 	}
+	if len(t.Steps) != 0 {
+		if len(r.Steps) != len(t.Steps) {
+			return false
+		}
+		for _, v := range r.Steps {
+			if !v.Matched {
+				return false
+			}
+		}
+	}
 	if t.MaxDuration != 0 {
 		if len(r.Log) == 0 {
 			return false
@@ -150,6 +332,9 @@ func (r TestResult) IsSuccess() bool {
 		if (v.Step == StepReadMessage) && readMessageFaliures[v.Kind] {
 			return false
 		}
+		if pingFaliures[v.Kind] {
+			return false
+		}
 	}
 	return true
 }
@@ -182,16 +367,24 @@ func testWS(ctx context.Context, wt Test) (TestResult, error) {
 		}
 		log.Println(id, "new test", string(data))
 	}
+	tlsConfig, err := buildTLSConfig(wt.TLS)
+	if err != nil {
+		return TestResult{}, err
+	}
 	dialer := &websocket.Dialer{
 		Proxy:            http.ProxyFromEnvironment,
 		HandshakeTimeout: wt.HandshakeTimeout.D(),
+		TLSClientConfig:  tlsConfig,
+		Subprotocols:     wt.Subprotocols,
 	}
+	requestHeader := buildHeaders(wt)
 	start := time.Now()
 	timestamp := func() Duration {
 		return Duration(time.Now().Sub(start))
 	}
 
 	wr := TestResult{ID: id, Test: wt, StartedAt: start}
+	var logMu sync.Mutex
 	addLog := func(kind string, action string, log ...Log) {
 		if len(log) > 1 {
 			panic("only one log item supported")
@@ -209,26 +402,243 @@ func testWS(ctx context.Context, wt Test) (TestResult, error) {
 			l.CreatedAt = timestamp().MS()
 		}
 
+		logMu.Lock()
 		wr.Log = append(wr.Log, l)
+		logMu.Unlock()
 	}
 
-	// Connect to the server
-	addLog(LogConnect, StepConnect)
-	log.Printf("%s Connecting to %s", wr.ID, wt.URL)
-	c, _, err := dialer.Dial(wt.URL, nil)
-	if err != nil {
-		addLog(LogConnectFail, StepConnect, Log{Err: err})
-		log.Println(wr.ID, "Cannot connect to websocket")
+	reconnectMin := wt.ReconnectMin.D()
+	if reconnectMin == 0 {
+		reconnectMin = time.Second
+	}
+	reconnectMax := wt.ReconnectMax.D()
+	if reconnectMax == 0 {
+		reconnectMax = 30 * time.Second
+	}
+	reconnectFactor := wt.ReconnectFactor
+	if reconnectFactor == 0 {
+		reconnectFactor = 2
+	}
+	reconnectBackoff := &backoff.Backoff{
+		Min:    reconnectMin,
+		Max:    reconnectMax,
+		Factor: reconnectFactor,
+		Jitter: true,
+	}
+
+	// waitToReconnect reports whether the run should redial after a
+	// connect or mid-run failure, sleeping for the backoff duration first.
+	waitToReconnect := func() bool {
+		if !wt.Reconnect {
+			return false
+		}
+		sleep := reconnectBackoff.Duration()
+		addLog(LogReconnect, StepConnect, Log{Value: sleep.String()})
+		select {
+		case <-time.After(sleep):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		// Connect to the server
+		addLog(LogConnect, StepConnect)
+		log.Printf("%s Connecting to %s", wr.ID, wt.URL)
+		c, _, err := dialer.DialContext(ctx, wt.URL, requestHeader)
+		if err != nil {
+			addLog(LogConnectFail, StepConnect, Log{Err: err})
+			log.Println(wr.ID, "Cannot connect to websocket")
+			if waitToReconnect() {
+				continue
+			}
+			return wr, nil
+		}
+		addLog(LogConnectSuccess, StepConnect)
+		wr.ConnectOK = true
+		reconnectBackoff.Reset()
+		if sp := c.Subprotocol(); sp != "" {
+			addLog(LogSubprotocolNegotiated, StepConnect, Log{Value: sp})
+		}
+		if tlsConn, ok := c.UnderlyingConn().(*tls.Conn); ok {
+			addLog(LogTLSPeerCertificates, StepConnect, Log{Value: certSummaries(tlsConn.ConnectionState().PeerCertificates)})
+		}
+		c.SetCloseHandler(func(code int, text string) error {
+			log.Println(wr.ID, code, text)
+			return nil
+		})
+		log.Println(wr.ID, "connected")
+
+		runErr := runConnection(ctx, wt, &wr, c, start, timestamp, addLog)
+		c.Close()
+		if runErr == nil {
+			return wr, nil
+		}
+		if waitToReconnect() {
+			continue
+		}
 		return wr, nil
 	}
-	addLog(LogConnectSuccess, StepConnect)
-	wr.ConnectOK = true
-	c.SetCloseHandler(func(code int, text string) error {
-		log.Println(wr.ID, code, text)
-		return nil
-	})
-	log.Println(wr.ID, "connected")
-	defer c.Close()
+}
+
+// runConnection drives a single connection for a test: it wires up the
+// keepalive ping loop, sends/receives the configured messages and closes
+// the connection, accumulating results into wr. A non-nil error means the
+// run ended before the test script completed: a read/write failure, an
+// unexpected server close code or an unmatched step; the caller decides
+// whether to redial.
+func runConnection(ctx context.Context, wt Test, wr *TestResult, c *websocket.Conn, start time.Time, timestamp func() Duration, addLog func(kind, step string, log ...Log)) error {
+	// gorilla/websocket forbids concurrent writes, so every WriteMessage
+	// and WriteControl call (including the ping loop below) goes through
+	// this mutex.
+	var writeMu sync.Mutex
+	writeMessage := func(messageType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return c.WriteMessage(messageType, data)
+	}
+	writeControl := func(messageType int, data []byte, deadline time.Time) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return c.WriteControl(messageType, data, deadline)
+	}
+
+	// gorilla/websocket only invokes the pong handler (and processes other
+	// control frames) while a goroutine is blocked inside ReadMessage, so a
+	// single reader-pump goroutine keeps one ReadMessage call in flight for
+	// the lifetime of the connection. Data messages it reads are handed to
+	// whichever call site is currently waiting for one over reads; nothing
+	// is lost if no one is waiting, since the pump blocks delivering that
+	// message until waitForMessage is next called.
+	type readResult struct {
+		messageType int
+		data        []byte
+		err         error
+		readLatency time.Duration
+	}
+	reads := make(chan readResult)
+	pumpStop := make(chan struct{})
+	var pumpWG sync.WaitGroup
+	pumpWG.Add(1)
+	go func() {
+		defer pumpWG.Done()
+		for {
+			readStartedAt := time.Now()
+			messageType, data, err := c.ReadMessage()
+			select {
+			case reads <- readResult{messageType, data, err, time.Since(readStartedAt)}:
+			case <-pumpStop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// waitForMessage also returns readLatency: the time the pump spent
+	// blocked inside ReadMessage producing this message, i.e. how long the
+	// message took to arrive once a read for it was outstanding.
+	waitForMessage := func() (int, []byte, time.Duration, error) {
+		select {
+		case r := <-reads:
+			return r.messageType, r.data, r.readLatency, r.err
+		case <-ctx.Done():
+			return 0, nil, 0, ctx.Err()
+		}
+	}
+
+	pingStop := make(chan struct{})
+	var pingWG sync.WaitGroup
+	if wt.PingInterval > 0 {
+		pongTimeout := wt.PongTimeout.D()
+		if pongTimeout == 0 {
+			pongTimeout = 10 * time.Second
+		}
+
+		var pingMu sync.Mutex
+		pending := map[int]time.Time{}
+		seq := 0
+
+		c.SetPongHandler(func(appData string) error {
+			n, err := strconv.Atoi(appData)
+			if err != nil {
+				return nil
+			}
+			pingMu.Lock()
+			sentAt, ok := pending[n]
+			delete(pending, n)
+			pingMu.Unlock()
+			if !ok {
+				return nil
+			}
+			addLog(LogPongReceived, StepPing, Log{Value: n})
+			wr.Pings = append(wr.Pings, PingResult{
+				Sequence:   n,
+				SentAt:     Duration(sentAt.Sub(start)).MS(),
+				ReceivedAt: timestamp().MS(),
+				RTT:        Duration(time.Since(sentAt)).MS(),
+			})
+			return nil
+		})
+
+		pingWG.Add(1)
+		go func() {
+			defer pingWG.Done()
+			ticker := time.NewTicker(wt.PingInterval.D())
+			defer ticker.Stop()
+			for {
+				select {
+				case <-pingStop:
+					return
+				case <-ticker.C:
+					pingMu.Lock()
+					n := seq
+					seq++
+					pending[n] = time.Now()
+					pingMu.Unlock()
+
+					addLog(LogPingSent, StepPing, Log{Value: n})
+					if err := writeControl(websocket.PingMessage, []byte(strconv.Itoa(n)), time.Now().Add(writeWait)); err != nil {
+						return
+					}
+
+					timer := time.NewTimer(pongTimeout)
+					select {
+					case <-timer.C:
+						pingMu.Lock()
+						_, stillPending := pending[n]
+						delete(pending, n)
+						pingMu.Unlock()
+						if stillPending {
+							addLog(LogPongTimeout, StepPing, Log{Value: n})
+						}
+					case <-pingStop:
+						timer.Stop()
+						return
+					}
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(pingStop)
+		pingWG.Wait()
+		// The pump may still be blocked inside ReadMessage; closing the
+		// connection here (the caller's own c.Close() right after we
+		// return is then a harmless no-op) forces that call to return so
+		// pumpStop takes effect and pumpWG.Wait() below is guaranteed to
+		// complete. Without joining it, SetPongHandler above can still be
+		// appending to wr.Pings, unsynchronized, after this function
+		// returns wr to a caller about to read/marshal it.
+		c.Close()
+		close(pumpStop)
+		pumpWG.Wait()
+	}()
+
+	if len(wt.Steps) > 0 {
+		return runSteps(ctx, wt, wr, c, timestamp, addLog, writeMessage, writeControl, waitForMessage)
+	}
 
 	handleWrite := func(ignoreTimeout bool, step string) error {
 		var err error
@@ -238,7 +648,7 @@ func testWS(ctx context.Context, wt Test) (TestResult, error) {
 			addLog(LogSetWriteDeadlineFailed, step, Log{Err: err})
 			return err
 		}
-		err = c.WriteMessage(websocket.TextMessage, []byte(wt.SendTextMessage))
+		err = writeMessage(websocket.TextMessage, []byte(wt.SendTextMessage))
 		if err != nil {
 			switch err := err.(type) {
 			case *websocket.CloseError:
@@ -271,7 +681,7 @@ func testWS(ctx context.Context, wt Test) (TestResult, error) {
 			return err
 		}
 		addLog(LogReadMessage, step)
-		msgType, data, err := c.ReadMessage()
+		msgType, data, readLatency, err := waitForMessage()
 		if err != nil {
 			switch err := err.(type) {
 			case *websocket.CloseError:
@@ -299,15 +709,17 @@ func testWS(ctx context.Context, wt Test) (TestResult, error) {
 			addLog(LogReadMessageSuccess, step, Log{Value: msgType})
 			if msgType == websocket.BinaryMessage {
 				wr.Messages = append(wr.Messages, WebsocketMessage{
-					Type:       msgType,
-					Body:       data,
-					ReceivedAt: timestamp().MS(),
+					Type:        msgType,
+					Body:        data,
+					ReceivedAt:  timestamp().MS(),
+					ReadLatency: Duration(readLatency).MS(),
 				})
 			} else {
 				wr.Messages = append(wr.Messages, WebsocketMessage{
-					Type:       msgType,
-					Body:       string(data),
-					ReceivedAt: timestamp().MS(),
+					Type:        msgType,
+					Body:        string(data),
+					ReceivedAt:  timestamp().MS(),
+					ReadLatency: Duration(readLatency).MS(),
 				})
 			}
 			log.Println(wr.ID, string(data))
@@ -317,31 +729,49 @@ func testWS(ctx context.Context, wt Test) (TestResult, error) {
 	}
 
 	if wt.SendTextMessage != "" {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := handleWrite(false, StepSendText); err != nil {
-			return wr, nil
+			return err
 		}
 	}
 
 	for wr.MessagesReceived < wt.ExpectMessages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := handleRead(false, StepReadMessage); err != nil {
-			return wr, nil
+			return err
 		}
 	}
 
 	if wt.ExpectServerClose != 0 {
-		if err := handleRead(false, StepExpectedServerClose); err != nil {
-			return wr, nil
+		err := handleRead(false, StepExpectedServerClose)
+		if err != nil {
+			ce, ok := err.(*websocket.CloseError)
+			if !ok || ce.Code != wt.ExpectServerClose {
+				return err
+			}
+			// The server closed the connection with the expected code,
+			// which is what we were waiting for; IsSuccess already
+			// compares ServerCloseCode against wt.ExpectServerClose, so
+			// this isn't a run failure worth reconnecting over, and
+			// there's no connection left to send our own close frame
+			// over. An unexpected close code falls through to the
+			// return above instead, so Reconnect can redial.
+			return nil
 		}
 	} else {
 		if err := handleRead(true, StepUnexpectedServerClose); err != nil {
-			return wr, nil
+			return err
 		}
 	}
 
 	// close the connection
 	addLog(LogClientCloseConnection, StepClientClose)
 	log.Println(wr.ID, "Requesting connection closure")
-	err = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	err := writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
 		spew.Dump(err)
 		addLog(LogClientCloseConnectionFailed, StepClientClose, Log{Err: err})
@@ -349,11 +779,163 @@ func testWS(ctx context.Context, wt Test) (TestResult, error) {
 			log.Println(wr.ID, err.Code)
 		}
 		log.Println(wr.ID, "Error while closing websocket", err)
-		return wr, nil
-
+		return err
 	}
 	addLog(LogClientCloseConnectionSuccess, StepClientClose)
 	wr.CloseOK = true
-	return wr, nil
+	return nil
+}
+
+// readErrorLogKind maps an error returned from websocket.Conn.ReadMessage
+// to the Log kind that best describes it.
+func readErrorLogKind(err error) string {
+	switch err := err.(type) {
+	case *websocket.CloseError:
+		return LogServerClosedConnection
+	case net.Error:
+		if err.Timeout() {
+			return LogReadMessageTimeout
+		}
+		return LogReadMessageNetError
+	default:
+		return LogReadMessageError
+	}
+}
+
+// runSteps walks wt.Steps sequentially, the scripted alternative to the
+// SendTextMessage/ExpectMessages protocol in runConnection above. It stops
+// at the first unmatched step, leaving the remaining steps unrecorded.
+func runSteps(ctx context.Context, wt Test, wr *TestResult, c *websocket.Conn, timestamp func() Duration, addLog func(kind, step string, log ...Log), writeMessage func(int, []byte) error, writeControl func(int, []byte, time.Time) error, waitForMessage func() (int, []byte, time.Duration, error)) error {
+	for i, step := range wt.Steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sr := StepResult{Index: i, Kind: step.Kind, StartedAt: timestamp().MS()}
+
+		readTimeout := wt.MessageReadTimeout.D()
+		writeTimeout := wt.MessageWriteTimeout.D()
+		if step.Timeout != 0 {
+			readTimeout = step.Timeout.D()
+			writeTimeout = step.Timeout.D()
+		}
+
+		switch step.Kind {
+		case StepKindSendText:
+			err := c.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err == nil {
+				err = writeMessage(websocket.TextMessage, []byte(step.Body))
+			}
+			sr.Matched = err == nil
+			sr.Err = err
+			if err != nil {
+				addLog(LogWriteMessageError, StepScript, Log{Err: err})
+			} else {
+				addLog(LogWriteMessageSuccess, StepScript)
+			}
+
+		case StepKindSendBinary:
+			err := c.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err == nil {
+				err = writeMessage(websocket.BinaryMessage, step.BinaryBody)
+			}
+			sr.Matched = err == nil
+			sr.Err = err
+			if err != nil {
+				addLog(LogWriteMessageError, StepScript, Log{Err: err})
+			} else {
+				addLog(LogWriteMessageSuccess, StepScript)
+			}
 
+		case StepKindSendPing:
+			err := writeControl(websocket.PingMessage, []byte(step.Body), time.Now().Add(writeTimeout))
+			sr.Matched = err == nil
+			sr.Err = err
+			if err != nil {
+				addLog(LogWriteMessageError, StepScript, Log{Err: err})
+			} else {
+				addLog(LogPingSent, StepScript)
+			}
+
+		case StepKindExpectText, StepKindExpectBinary:
+			wantType := websocket.TextMessage
+			if step.Kind == StepKindExpectBinary {
+				wantType = websocket.BinaryMessage
+			}
+			if err := c.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+				sr.Err = err
+				addLog(LogSetReadDeadlineFailed, StepScript, Log{Err: err})
+				break
+			}
+			addLog(LogReadMessage, StepScript)
+			msgType, data, readLatency, err := waitForMessage()
+			if err != nil {
+				sr.Err = err
+				addLog(readErrorLogKind(err), StepScript, Log{Err: err})
+				if ce, ok := err.(*websocket.CloseError); ok {
+					wr.ServerCloseCode = ce.Code
+				}
+				break
+			}
+			addLog(LogReadMessageSuccess, StepScript, Log{Value: msgType})
+			wr.MessagesReceived++
+			body := string(data)
+			wr.Messages = append(wr.Messages, WebsocketMessage{
+				Type:        msgType,
+				Body:        body,
+				ReceivedAt:  timestamp().MS(),
+				ReadLatency: Duration(readLatency).MS(),
+			})
+			sr.Body = body
+			if msgType != wantType {
+				sr.Matched = false
+			} else if matched, err := step.Match.matches(body); err != nil {
+				sr.Err = err
+			} else {
+				sr.Matched = matched
+			}
+
+		case StepKindExpectClose:
+			if err := c.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+				sr.Err = err
+				addLog(LogSetReadDeadlineFailed, StepScript, Log{Err: err})
+				break
+			}
+			_, _, _, err := waitForMessage()
+			ce, ok := err.(*websocket.CloseError)
+			if !ok {
+				sr.Err = err
+				if err != nil {
+					addLog(readErrorLogKind(err), StepScript, Log{Err: err})
+				}
+				break
+			}
+			wr.ServerCloseCode = ce.Code
+			addLog(LogServerClosedConnection, StepScript, Log{Err: ce})
+			if step.Match != nil && step.Match.Equals != "" {
+				sr.Matched = strconv.Itoa(ce.Code) == step.Match.Equals
+			} else {
+				sr.Matched = true
+			}
+
+		case StepKindWait:
+			select {
+			case <-time.After(step.Wait.D()):
+				sr.Matched = true
+			case <-ctx.Done():
+				sr.Err = ctx.Err()
+			}
+
+		default:
+			sr.Err = fmt.Errorf("unknown step kind %q", step.Kind)
+		}
+
+		wr.Steps = append(wr.Steps, sr)
+		if !sr.Matched {
+			if sr.Err != nil {
+				return sr.Err
+			}
+			return fmt.Errorf("step %d (%s) did not match", i, step.Kind)
+		}
+	}
+	return nil
 }